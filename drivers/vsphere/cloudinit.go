@@ -0,0 +1,97 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package vsphere
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cloudInitSupportDir exists as soon as cloud-init starts running on boot,
+// well before it finishes. Its presence tells us the boot2docker image has
+// a cloud-init datasource at all, independent of whether it has finished
+// processing the guestinfo user-data we handed it yet.
+const cloudInitSupportDir = "/var/lib/cloud"
+
+// cloudInitMarkerFile is written by cloud-init once it has finished running
+// all boot stages.
+const cloudInitMarkerFile = "/var/lib/cloud/instance/boot-finished"
+
+// cloudInitWaitTimeout bounds how long we poll for cloudInitMarkerFile
+// before giving up with an error. Whether to fall back to the SSH bootstrap
+// flow is decided beforehand from cloudInitSupportDir, not by this timeout.
+const cloudInitWaitTimeout = 60 * time.Second
+
+// generateCloudInit renders the user-data document injected into the VM via
+// guestinfo.userdata. It authorizes d's SSH key, sets the VM hostname, and
+// restarts docker once identity auth has been configured.
+func generateCloudInit(d *Driver) (string, error) {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return "", err
+	}
+
+	userData := fmt.Sprintf(`#cloud-config
+hostname: %s
+ssh_authorized_keys:
+  - %s
+runcmd:
+  - [ sudo, /etc/init.d/docker, restart ]
+`, d.MachineName, strings.TrimSpace(string(pubKey)))
+
+	return userData, nil
+}
+
+// generateCloudInitMetadata renders the guestinfo.metadata document. It only
+// needs to carry the instance and local hostname; networking is handled by
+// the VM's DHCP-configured NIC.
+func generateCloudInitMetadata(d *Driver) string {
+	return fmt.Sprintf(`instance-id: %s
+local-hostname: %s
+`, d.MachineName, d.MachineName)
+}
+
+// cloudInitSupported reports whether the VM's boot2docker image has a
+// cloud-init datasource at all. This is checked via guest operations, not
+// SSH: the guest's SSH daemon may still be starting up, or this image may
+// never bring one up via cloud-init in the first place, so probing over
+// SSH here would make the very fallback this function selects unreachable.
+func (d *Driver) cloudInitSupported(vc *VcClient) (bool, error) {
+	return vc.GuestFileExists("docker", "tcuser", cloudInitSupportDir)
+}
+
+// waitForCloudInit polls the guest via guest operations for cloudInitMarkerFile
+// until it appears or cloudInitWaitTimeout elapses.
+func (d *Driver) waitForCloudInit(vc *VcClient) error {
+	deadline := time.Now().Add(cloudInitWaitTimeout)
+	for time.Now().Before(deadline) {
+		done, err := vc.GuestFileExists("docker", "tcuser", cloudInitMarkerFile)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for cloud-init to finish on %s", d.MachineName)
+}
+
+// provisionCloudInit sets the guestinfo user-data/metadata that the VM's
+// cloud-init datasource will pick up on first boot. It must run before the
+// VM is first powered on.
+func (d *Driver) provisionCloudInit(vc *VcClient) error {
+	log.Infof("Injecting cloud-init user-data for %s...", d.MachineName)
+	userData, err := generateCloudInit(d)
+	if err != nil {
+		return err
+	}
+	metaData := generateCloudInitMetadata(d)
+	return vc.VmSetGuestinfo(userData, metaData)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package vsphere
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// progressLogInterval controls how often downloadISO logs progress while
+// streaming the response body.
+const progressLogInterval = 10 * 1024 * 1024 // 10 MB
+
+// downloadISO fetches the boot2docker ISO at url and saves it as file in
+// dir, resuming a previous partial download when possible and verifying
+// its contents against expectedSHA256 (or a sibling "<url>.sha256" file
+// when expectedSHA256 is empty) before it is made visible under its final
+// name.
+func downloadISO(dir, file, url, expectedSHA256 string) error {
+	dest := path.Join(dir, file)
+	tmpPath := dest + ".tmp"
+
+	offset, err := resumeOffset(url, tmpPath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset > 0 {
+		log.Infof("Resuming boot2docker download at byte %d...", offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if offset > 0 && rsp.StatusCode != http.StatusPartialContent {
+		// The server ignored our Range request; restart from scratch.
+		log.Warnf("Server does not support resuming the boot2docker download, restarting from the beginning")
+		offset = 0
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(tmpPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	// A network error here leaves a legitimately resumable partial file on
+	// disk; only a failed checksum below makes the partial file corrupt and
+	// worth deleting, so we don't remove it on this path.
+	counter := &progressCounter{offset: offset}
+	if _, err := io.Copy(f, io.TeeReader(rsp.Body, counter)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	expectedSHA256 = resolveExpectedSHA256(url, expectedSHA256)
+
+	if expectedSHA256 != "" {
+		log.Infof("Verifying boot2docker ISO checksum...")
+		if err := verifyChecksum(tmpPath, expectedSHA256); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	} else {
+		log.Warnf("No SHA256 checksum available for %s, skipping verification", url)
+	}
+
+	return os.Rename(tmpPath, dest)
+}
+
+// resumeOffset returns the size of a previously downloaded partial file at
+// tmpPath, or 0 if there is nothing to resume from: either no partial file
+// exists, the remote no longer advertises Range support, or the partial
+// file is already as large as (or larger than) what the remote reports.
+func resumeOffset(url, tmpPath string) (int64, error) {
+	fi, err := os.Stat(tmpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	rsp, err := http.Head(url)
+	if err != nil {
+		// A HEAD failure (e.g. a flaky network, or a server that doesn't
+		// support HEAD) shouldn't abort the download outright when a plain
+		// GET from the start would still work; just don't resume.
+		log.Warnf("Unable to check whether the boot2docker download can be resumed: %s", err)
+		return 0, nil
+	}
+	defer rsp.Body.Close()
+
+	if rsp.Header.Get("Accept-Ranges") != "bytes" {
+		return 0, nil
+	}
+
+	contentLength, err := strconv.ParseInt(rsp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || contentLength <= 0 {
+		return 0, nil
+	}
+
+	if fi.Size() >= contentLength {
+		// Stale or corrupt partial file from a different build; start over.
+		return 0, nil
+	}
+
+	return fi.Size(), nil
+}
+
+// resolveExpectedSHA256 returns expectedSHA256, trimmed and lowercased, if
+// it's non-empty; otherwise it tries to fetch a sibling "<url>.sha256" file. Any failure to
+// reach the sibling checksum is non-fatal: downloadISO just skips
+// verification and logs a warning.
+func resolveExpectedSHA256(url, expectedSHA256 string) string {
+	if expectedSHA256 != "" {
+		return strings.ToLower(strings.TrimSpace(expectedSHA256))
+	}
+
+	rsp, err := http.Get(url + ".sha256")
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		if rsp != nil {
+			rsp.Body.Close()
+		}
+		return ""
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return ""
+	}
+
+	// Sibling checksum files are typically "<hash>  <filename>" or just
+	// the bare hash; either way the hash is the first field.
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+func verifyChecksum(filePath, expectedSHA256 string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expectedSHA256 {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filePath, expectedSHA256, actual)
+	}
+	return nil
+}
+
+// progressCounter implements io.Writer so it can sit behind an io.TeeReader
+// and log download progress every progressLogInterval bytes.
+type progressCounter struct {
+	offset  int64
+	written int64
+	logged  int64
+}
+
+func (c *progressCounter) Write(p []byte) (int, error) {
+	c.written += int64(len(p))
+	if c.written-c.logged >= progressLogInterval {
+		log.Infof("Downloaded %d MB...", (c.offset+c.written)/(1024*1024))
+		c.logged = c.written
+	}
+	return len(p), nil
+}
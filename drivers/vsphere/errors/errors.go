@@ -0,0 +1,31 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package errors
+
+import "fmt"
+
+type InvalidStateError struct {
+	MachineName string
+}
+
+func NewInvalidStateError(machineName string) *InvalidStateError {
+	return &InvalidStateError{MachineName: machineName}
+}
+
+func (e *InvalidStateError) Error() string {
+	return fmt.Sprintf("vSphere machine %s is in an invalid state for this operation", e.MachineName)
+}
+
+type IncompleteVsphereConfigError struct {
+	MissingField string
+}
+
+func NewIncompleteVsphereConfigError(missingField string) *IncompleteVsphereConfigError {
+	return &IncompleteVsphereConfigError{MissingField: missingField}
+}
+
+func (e *IncompleteVsphereConfigError) Error() string {
+	return fmt.Sprintf("%s is missing from the vSphere configuration, please provide it and try again", e.MissingField)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package vsphere
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const nfsExportsFile = "/etc/exports"
+
+// nfsExportLine returns the /etc/exports entry used to share d.NFSSharePath
+// with the docker VM's actual guest subnet, in whichever exports(5) dialect
+// the host's nfsd understands: BSD syntax on macOS, GNU syntax (consumed by
+// exportfs) everywhere else.
+func (d *Driver) nfsExportLine() (string, error) {
+	network, netmask, err := d.guestSubnet()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "darwin" {
+		return fmt.Sprintf("%s -network %s -mask %s -alldirs -mapall=%s",
+			d.NFSSharePath, network, netmask, currentUser()), nil
+	}
+	return fmt.Sprintf("%s %s/%s(rw,sync,all_squash,anonuid=%s,anongid=%s)",
+		d.NFSSharePath, network, netmask, currentUID(), currentGID()), nil
+}
+
+// startNFSShare exports d.NFSSharePath from the workstation and mounts it
+// inside the guest. Because the vSphere driver targets a remote ESXi/vCenter
+// host rather than a local hypervisor, the workstation's export must be
+// reachable from the VM's network; if it isn't, we fail fast with a clear
+// error instead of silently mounting nothing.
+func (d *Driver) startNFSShare() error {
+	hostIP, err := d.routableHostIP()
+	if err != nil {
+		return err
+	}
+
+	exportLine, err := d.nfsExportLine()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Exporting %s over NFS...", d.NFSSharePath)
+	if err := addNFSExportLine(exportLine); err != nil {
+		return err
+	}
+	if err := reloadNFSDaemon(); err != nil {
+		return err
+	}
+
+	log.Infof("Mounting NFS share in the docker VM...")
+	mkdirCmd, err := d.GetSSHCommand(fmt.Sprintf("sudo mkdir -p %s", d.NFSSharePath))
+	if err != nil {
+		return err
+	}
+	if err := mkdirCmd.Run(); err != nil {
+		return fmt.Errorf("unable to create NFS mount point in guest: %s", err)
+	}
+
+	fstabLine := fmt.Sprintf("%s:%s %s nfs noacl,async,nfsvers=3 0 0", hostIP, d.NFSSharePath, d.NFSSharePath)
+	mountCmd := fmt.Sprintf(
+		"echo '%s' | sudo tee -a /etc/fstab > /dev/null && sudo mount %s",
+		fstabLine, d.NFSSharePath)
+	cmd, err := d.GetSSHCommand(mountCmd)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to mount NFS share %s in guest: %s", d.NFSSharePath, err)
+	}
+
+	return nil
+}
+
+// stopNFSShare unmounts the share from the guest and removes the host export.
+func (d *Driver) stopNFSShare() error {
+	cmd, err := d.GetSSHCommand(fmt.Sprintf(
+		"sudo umount %s && sudo sed -i.bak '\\#%s#d' /etc/fstab",
+		d.NFSSharePath, d.NFSSharePath))
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		log.Warnf("Unable to cleanly unmount NFS share from guest: %s", err)
+	}
+
+	if err := removeNFSExportLine(d.NFSSharePath); err != nil {
+		return err
+	}
+	return reloadNFSDaemon()
+}
+
+// routableHostIP returns the IP of the local IPv4 interface whose subnet
+// contains the docker VM's guest IP. If no local interface is on the guest's
+// subnet, it returns an error rather than exporting a share; a guest that is
+// reachable only through a router is reported the same way.
+func (d *Driver) routableHostIP() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	guestIP := net.ParseIP(d.guestIP)
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipNet.Contains(guestIP) {
+			return ipNet.IP.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"no local network interface is routable to %q's guest network (%s); "+
+			"NFS share %q would not be reachable from the guest", d.MachineName, d.guestIP, d.NFSSharePath)
+}
+
+// guestSubnet SSHes into the guest to determine the network/netmask of the
+// NIC carrying d.guestIP, so the /etc/exports entry is scoped to the VM's
+// actual subnet rather than an assumed one.
+func (d *Driver) guestSubnet() (network, netmask string, err error) {
+	cmd, err := d.GetSSHCommand("ip -4 -o addr show scope global")
+	if err != nil {
+		return "", "", err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to determine guest network configuration: %s", err)
+	}
+
+	for _, field := range strings.Fields(string(out)) {
+		if !strings.HasPrefix(field, d.guestIP+"/") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return "", "", err
+		}
+		return ipNet.IP.String(), net.IP(ipNet.Mask).String(), nil
+	}
+
+	return "", "", fmt.Errorf("unable to find guest network configuration for %s", d.guestIP)
+}
+
+func addNFSExportLine(line string) error {
+	existing, err := ioutil.ReadFile(nfsExportsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.Contains(string(existing), line) {
+		return nil
+	}
+
+	cmd := exec.Command("sudo", "sh", "-c", fmt.Sprintf("echo %q >> %s", line, nfsExportsFile))
+	return cmd.Run()
+}
+
+func removeNFSExportLine(sharePath string) error {
+	cmd := exec.Command("sudo", "sed", "-i.bak", fmt.Sprintf("\\#%s#d", sharePath), nfsExportsFile)
+	return cmd.Run()
+}
+
+func reloadNFSDaemon() error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("sudo", "nfsd", "restart")
+	default:
+		cmd = exec.Command("sudo", "exportfs", "-ra")
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to reload NFS daemon: %s", err)
+	}
+	return nil
+}
+
+// currentUser returns the invoking user's name, used as the NFS export's
+// -mapall target so the guest writes back to the share as that user rather
+// than as whatever UID the guest happens to run NFS requests as.
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Warnf("Unable to determine current user, mapping NFS share to nobody: %s", err)
+		return "nobody"
+	}
+	return u.Username
+}
+
+// currentUID and currentGID return the invoking user's numeric IDs, used as
+// the GNU exports(5) anonuid/anongid so the guest writes back to the share
+// as that user rather than as whatever UID the guest happens to run NFS
+// requests as.
+func currentUID() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Warnf("Unable to determine current user, mapping NFS share to nobody: %s", err)
+		return "65534"
+	}
+	return u.Uid
+}
+
+func currentGID() string {
+	u, err := user.Current()
+	if err != nil {
+		return "65534"
+	}
+	return u.Gid
+}
@@ -0,0 +1,457 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package vsphere
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VcClient is a thin, authenticated wrapper around the govmomi SOAP client.
+// Driver methods create one whenever they need it (a single driver call such
+// as Start may create several, e.g. through GetState and GetIP); each client
+// caches the finder lookups that would otherwise require a round trip to
+// vCenter for every operation made through it.
+type VcClient struct {
+	d *Driver
+
+	ctx    context.Context
+	client *govmomi.Client
+	finder *find.Finder
+
+	datacenter   *object.Datacenter
+	datastore    *object.Datastore
+	network      object.NetworkReference
+	resourcePool *object.ResourcePool
+	hostSystem   *object.HostSystem
+}
+
+// NewVcClient authenticates against vCenter/ESXi via SOAP and resolves the
+// Datacenter/Datastore/Network/ResourcePool/Host configured on the driver.
+// The returned client can be reused across multiple VM operations.
+func NewVcClient(d *Driver) (*VcClient, error) {
+	ctx := context.Background()
+
+	u, err := url.Parse(fmt.Sprintf("https://%s/sdk", d.IP))
+	if err != nil {
+		return nil, err
+	}
+	u.User = url.UserPassword(d.Username, d.Password)
+
+	client, err := govmomi.NewClient(ctx, u, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to vSphere at %s: %s", d.IP, err)
+	}
+
+	vc := &VcClient{
+		d:      d,
+		ctx:    ctx,
+		client: client,
+		finder: find.NewFinder(client.Client, true),
+	}
+
+	if err := vc.resolveInventory(); err != nil {
+		return nil, err
+	}
+
+	return vc, nil
+}
+
+func (vc *VcClient) resolveInventory() error {
+	dc, err := vc.finder.DatacenterOrDefault(vc.ctx, vc.d.Datacenter)
+	if err != nil {
+		return fmt.Errorf("unable to find datacenter %q: %s", vc.d.Datacenter, err)
+	}
+	vc.datacenter = dc
+	vc.finder.SetDatacenter(dc)
+
+	ds, err := vc.finder.DatastoreOrDefault(vc.ctx, vc.d.Datastore)
+	if err != nil {
+		return fmt.Errorf("unable to find datastore %q: %s", vc.d.Datastore, err)
+	}
+	vc.datastore = ds
+
+	net, err := vc.finder.NetworkOrDefault(vc.ctx, vc.d.Network)
+	if err != nil {
+		return fmt.Errorf("unable to find network %q: %s", vc.d.Network, err)
+	}
+	vc.network = net
+
+	pool, err := vc.finder.ResourcePoolOrDefault(vc.ctx, vc.d.Pool)
+	if err != nil {
+		return fmt.Errorf("unable to find resource pool %q: %s", vc.d.Pool, err)
+	}
+	vc.resourcePool = pool
+
+	if vc.d.HostIP != "" {
+		host, err := vc.finder.HostSystemOrDefault(vc.ctx, vc.d.HostIP)
+		if err != nil {
+			return fmt.Errorf("unable to find compute host %q: %s", vc.d.HostIP, err)
+		}
+		vc.hostSystem = host
+	}
+
+	return nil
+}
+
+func (vc *VcClient) vm() (*object.VirtualMachine, error) {
+	return vc.finder.VirtualMachine(vc.ctx, vc.d.MachineName)
+}
+
+// VmCreate creates a blank VM backed by the given datastore ISO path, with
+// the boot2docker image mounted as its CD-ROM.
+func (vc *VcClient) VmCreate(isoPath string) error {
+	var devices object.VirtualDeviceList
+	scsi, err := devices.CreateSCSIController("pvscsi")
+	if err != nil {
+		return err
+	}
+	devices = append(devices, scsi)
+
+	deviceChanges, err := devices.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	if err != nil {
+		return err
+	}
+
+	spec := types.VirtualMachineConfigSpec{
+		Name:         vc.d.MachineName,
+		GuestId:      "otherLinux64Guest",
+		Files:        &types.VirtualMachineFileInfo{VmPathName: fmt.Sprintf("[%s]", vc.datastore.Name())},
+		NumCPUs:      int32(vc.d.CPU),
+		MemoryMB:     int64(vc.d.Memory),
+		DeviceChange: deviceChanges,
+	}
+
+	folders, err := vc.datacenter.Folders(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	task, err := folders.VmFolder.CreateVM(vc.ctx, spec, vc.resourcePool, vc.hostSystem)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to create VM %q: %s", vc.d.MachineName, err)
+	}
+
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	devices, err := vmObj.Device(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	cdrom, err := devices.FindCdrom("")
+	if err != nil {
+		cdrom, err = devices.CreateCdrom(&types.VirtualIDEController{})
+		if err != nil {
+			return err
+		}
+	}
+	cdrom = devices.InsertIso(cdrom, vc.datastore.Path(isoPath))
+
+	return vmObj.AddDevice(vc.ctx, cdrom)
+}
+
+// VmDiskCreate attaches a disk of d.DiskSize (MB) to the VM.
+func (vc *VcClient) VmDiskCreate() error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	devices, err := vmObj.Device(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	controller, err := devices.FindSCSIController("")
+	if err != nil {
+		return fmt.Errorf("unable to find SCSI controller on VM %q: %s", vc.d.MachineName, err)
+	}
+
+	disk := devices.CreateDisk(controller, vc.datastore.Reference(),
+		vc.datastore.Path(fmt.Sprintf("%s/%s.vmdk", vc.d.MachineName, vc.d.MachineName)))
+	disk.CapacityInKB = int64(vc.d.DiskSize) * 1024
+
+	return vmObj.AddDevice(vc.ctx, disk)
+}
+
+// VmAttachNetwork attaches the configured network to the VM's primary NIC.
+func (vc *VcClient) VmAttachNetwork() error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	backing, err := vc.network.EthernetCardBackingInfo(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	nic, err := object.EthernetCardTypes().CreateEthernetCard("vmxnet3", backing)
+	if err != nil {
+		return err
+	}
+
+	return vmObj.AddDevice(vc.ctx, nic)
+}
+
+// VmSetGuestinfo writes the cloud-init user-data/metadata documents into
+// the VM's ExtraConfig under the guestinfo.* namespace its vmtoolsd-backed
+// cloud-init datasource reads on first boot. Must be called before the VM
+// is powered on for the first time.
+func (vc *VcClient) VmSetGuestinfo(userData, metaData string) error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	encodedUserData := base64.StdEncoding.EncodeToString([]byte(userData))
+
+	spec := types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.userdata", Value: encodedUserData},
+			&types.OptionValue{Key: "guestinfo.userdata.encoding", Value: "base64"},
+			&types.OptionValue{Key: "guestinfo.metadata", Value: metaData},
+		},
+	}
+
+	task, err := vmObj.Reconfigure(vc.ctx, spec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to set guestinfo on VM %q: %s", vc.d.MachineName, err)
+	}
+	return nil
+}
+
+// VmPowerOn powers on the VM and waits for the power state change to commit.
+func (vc *VcClient) VmPowerOn() error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	task, err := vmObj.PowerOn(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to power on VM %q: %s", vc.d.MachineName, err)
+	}
+	return nil
+}
+
+// VmPowerOff powers off the VM and waits for the power state change to commit.
+func (vc *VcClient) VmPowerOff() error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	task, err := vmObj.PowerOff(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to power off VM %q: %s", vc.d.MachineName, err)
+	}
+	return nil
+}
+
+// VmDestroy powers off (if needed) and removes the VM from disk.
+func (vc *VcClient) VmDestroy() error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	powerState, err := vc.VmPowerState()
+	if err != nil {
+		return err
+	}
+	if powerState == types.VirtualMachinePowerStatePoweredOn {
+		if err := vc.VmPowerOff(); err != nil {
+			return err
+		}
+	}
+
+	task, err := vmObj.Destroy(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to destroy VM %q: %s", vc.d.MachineName, err)
+	}
+	return nil
+}
+
+// VmPowerState returns the VM's current power state.
+func (vc *VcClient) VmPowerState() (types.VirtualMachinePowerState, error) {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return "", err
+	}
+
+	var mvm mo.VirtualMachine
+	if err := vmObj.Properties(vc.ctx, vmObj.Reference(), []string{"runtime.powerState"}, &mvm); err != nil {
+		return "", err
+	}
+	return mvm.Runtime.PowerState, nil
+}
+
+// VmFetchIP waits for VMware Tools to report an IP address and returns it.
+func (vc *VcClient) VmFetchIP() (string, error) {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return "", err
+	}
+
+	ip, err := vmObj.WaitForIP(vc.ctx)
+	if err != nil {
+		return "", fmt.Errorf("timed out waiting for VM %q to report an IP: %s", vc.d.MachineName, err)
+	}
+	return ip, nil
+}
+
+// DatastoreMkdir creates dir at the root of the configured datastore.
+func (vc *VcClient) DatastoreMkdir(dir string) error {
+	dsClient := vc.datastore.NewFileManager(vc.client.Client, false)
+	if err := dsClient.MakeDirectory(vc.ctx, vc.datastore.Path(dir), true); err != nil {
+		return fmt.Errorf("unable to create datastore directory %q: %s", dir, err)
+	}
+	return nil
+}
+
+// DatastoreUpload uploads localPath to the datastore via its HTTP endpoint,
+// replacing the previous `govc datastore.upload` subprocess call.
+func (vc *VcClient) DatastoreUpload(localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	dest := fmt.Sprintf("%s/%s", DATASTORE_DIR, B2D_ISO_NAME)
+	p := soap.DefaultUpload
+	p.ContentLength = fi.Size()
+
+	log.Infof("Uploading %s to datastore %s...", localPath, vc.datastore.Name())
+	if err := vc.datastore.Upload(vc.ctx, f, dest, &p); err != nil {
+		return fmt.Errorf("unable to upload %q to datastore: %s", localPath, err)
+	}
+	return nil
+}
+
+// GuestMkdir creates a directory inside the guest OS via guest operations,
+// replacing the previous `govc guest.mkdir` subprocess call.
+func (vc *VcClient) GuestMkdir(username, password, guestPath string) error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	ops, err := guest.NewOperationsManager(vc.client.Client, vmObj.Reference()).FileManager(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	auth := types.NamePasswordAuthentication{Username: username, Password: password}
+	if err := ops.MakeDirectory(vc.ctx, &auth, guestPath, true); err != nil {
+		return fmt.Errorf("unable to create guest directory %q: %s", guestPath, err)
+	}
+	return nil
+}
+
+// GuestFileExists reports whether guestPath exists in the guest OS, checked
+// via guest operations rather than SSH so it works before (or regardless
+// of whether) the guest's SSH daemon and authorized_keys are set up.
+func (vc *VcClient) GuestFileExists(username, password, guestPath string) (bool, error) {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return false, err
+	}
+
+	ops, err := guest.NewOperationsManager(vc.client.Client, vmObj.Reference()).FileManager(vc.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	auth := types.NamePasswordAuthentication{Username: username, Password: password}
+	if _, err := ops.ListFiles(vc.ctx, &auth, guestPath, 0, nil, ""); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// GuestUpload copies localPath into the guest OS at guestPath via guest
+// operations, replacing the previous `govc guest.upload` subprocess call.
+func (vc *VcClient) GuestUpload(username, password, localPath, guestPath string) error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ops, err := guest.NewOperationsManager(vc.client.Client, vmObj.Reference()).FileManager(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	auth := types.NamePasswordAuthentication{Username: username, Password: password}
+	url, err := ops.InitiateFileTransferToGuest(vc.ctx, &auth, guestPath, &types.GuestFileAttributes{}, fi.Size(), true)
+	if err != nil {
+		return fmt.Errorf("unable to initiate guest upload of %q: %s", guestPath, err)
+	}
+
+	u, err := vc.client.Client.ParseURL(url)
+	if err != nil {
+		return err
+	}
+
+	if err := vc.client.Client.Upload(f, u, &soap.DefaultUpload); err != nil {
+		return fmt.Errorf("unable to upload %q to guest path %q: %s", localPath, guestPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2014 VMware, Inc.  All rights reserved.  Licensed under the Apache v2 License.
+ */
+
+package vsphere
+
+import (
+	"fmt"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/vcenter"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VmCloneFromTemplate clones templateName, an existing VM or VM template in
+// the vSphere inventory, into a new VM named after the driver's machine
+// name, placed on the configured Datastore/Pool/Host.
+func (vc *VcClient) VmCloneFromTemplate(templateName string) error {
+	template, err := vc.finder.VirtualMachine(vc.ctx, templateName)
+	if err != nil {
+		return fmt.Errorf("unable to find template %q: %s", templateName, err)
+	}
+
+	folders, err := vc.datacenter.Folders(vc.ctx)
+	if err != nil {
+		return err
+	}
+
+	relocateSpec := types.VirtualMachineRelocateSpec{
+		Datastore: types.NewReference(vc.datastore.Reference()),
+		Pool:      types.NewReference(vc.resourcePool.Reference()),
+	}
+	if vc.hostSystem != nil {
+		ref := vc.hostSystem.Reference()
+		relocateSpec.Host = &ref
+	}
+
+	cloneSpec := types.VirtualMachineCloneSpec{
+		Location: relocateSpec,
+		PowerOn:  false,
+		Template: false,
+	}
+
+	task, err := template.Clone(vc.ctx, folders.VmFolder, vc.d.MachineName, cloneSpec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to clone template %q: %s", templateName, err)
+	}
+	return nil
+}
+
+// VmDeployFromContentLibrary deploys itemName from libraryName, a Content
+// Library OVF item, as a new VM named after the driver's machine name. It
+// authenticates a separate REST session, since the Content Library API is
+// exposed over vAPI rather than the legacy SOAP API used everywhere else.
+func (vc *VcClient) VmDeployFromContentLibrary(libraryName, itemName string) error {
+	restClient := rest.NewClient(vc.client.Client)
+	if err := restClient.Login(vc.ctx, url.UserPassword(vc.d.Username, vc.d.Password)); err != nil {
+		return fmt.Errorf("unable to authenticate to the Content Library service: %s", err)
+	}
+	defer restClient.Logout(vc.ctx)
+
+	libMgr := library.NewManager(restClient)
+
+	lib, err := libMgr.GetLibraryByName(vc.ctx, libraryName)
+	if err != nil {
+		return fmt.Errorf("unable to find content library %q: %s", libraryName, err)
+	}
+
+	item, err := libMgr.GetLibraryItemByName(vc.ctx, lib.ID, itemName)
+	if err != nil {
+		return fmt.Errorf("unable to find content library item %q in library %q: %s", itemName, libraryName, err)
+	}
+
+	deploy := vcenter.Deploy{
+		DeploymentSpec: vcenter.DeploymentSpec{
+			Name:               vc.d.MachineName,
+			DefaultDatastoreID: vc.datastore.Reference().Value,
+			AcceptAllEULA:      true,
+		},
+		Target: vcenter.Target{
+			ResourcePoolID: vc.resourcePool.Reference().Value,
+		},
+	}
+
+	vcMgr := vcenter.NewManager(restClient)
+	if _, err := vcMgr.DeployLibraryItem(vc.ctx, item.ID, deploy); err != nil {
+		return fmt.Errorf("unable to deploy content library item %q: %s", itemName, err)
+	}
+	return nil
+}
+
+// VmResize reconfigures an already-created VM's CPU/memory and resizes its
+// primary disk. Used after cloning a template or deploying a Content
+// Library item, since neither path takes the driver's requested sizing.
+func (vc *VcClient) VmResize(cpu, memoryMB, diskMB int) error {
+	vmObj, err := vc.vm()
+	if err != nil {
+		return err
+	}
+
+	spec := types.VirtualMachineConfigSpec{
+		NumCPUs:  int32(cpu),
+		MemoryMB: int64(memoryMB),
+	}
+	task, err := vmObj.Reconfigure(vc.ctx, spec)
+	if err != nil {
+		return err
+	}
+	if _, err := task.WaitForResult(vc.ctx, nil); err != nil {
+		return fmt.Errorf("unable to resize VM %q: %s", vc.d.MachineName, err)
+	}
+
+	devices, err := vmObj.Device(vc.ctx)
+	if err != nil {
+		return err
+	}
+	disk, err := devices.FindDisk("")
+	if err != nil {
+		return fmt.Errorf("unable to find primary disk on VM %q: %s", vc.d.MachineName, err)
+	}
+
+	requestedKB := int64(diskMB) * 1024
+	if requestedKB <= disk.CapacityInKB {
+		log.Infof("Requested disk size for %s is not larger than the template's disk, leaving it as-is", vc.d.MachineName)
+		return nil
+	}
+	disk.CapacityInKB = requestedKB
+
+	if err := vmObj.EditDevice(vc.ctx, disk); err != nil {
+		return fmt.Errorf("unable to resize disk on VM %q: %s", vc.d.MachineName, err)
+	}
+	return nil
+}
@@ -6,14 +6,10 @@ package vsphere
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	flag "github.com/docker/docker/pkg/mflag"
@@ -22,6 +18,7 @@ import (
 	"github.com/docker/machine/drivers/vsphere/errors"
 	"github.com/docker/machine/ssh"
 	"github.com/docker/machine/state"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 const (
@@ -31,39 +28,52 @@ const (
 )
 
 type Driver struct {
-	MachineName    string
-	SSHPort        int
-	CPU            int
-	Memory         int
-	DiskSize       int
-	Boot2DockerURL string
-	IP             string
-	Username       string
-	Password       string
-	Network        string
-	Datastore      string
-	Datacenter     string
-	Pool           string
-	HostIP         string
-	StorePath      string
-	ISO            string
+	MachineName          string
+	SSHPort              int
+	CPU                  int
+	Memory               int
+	DiskSize             int
+	Boot2DockerURL       string
+	IP                   string
+	Username             string
+	Password             string
+	Network              string
+	Datastore            string
+	Datacenter           string
+	Pool                 string
+	HostIP               string
+	StorePath            string
+	ISO                  string
+	NFSShare             bool
+	NFSSharePath         string
+	Template             string
+	ContentLibrary       string
+	ContentLibraryItem   string
+	Boot2DockerURLSHA256 string
 
 	storePath string
+	guestIP   string
 }
 
 type CreateFlags struct {
-	CPU            *int
-	Memory         *int
-	DiskSize       *int
-	Boot2DockerURL *string
-	IP             *string
-	Username       *string
-	Password       *string
-	Network        *string
-	Datastore      *string
-	Datacenter     *string
-	Pool           *string
-	HostIP         *string
+	CPU                  *int
+	Memory               *int
+	DiskSize             *int
+	Boot2DockerURL       *string
+	IP                   *string
+	Username             *string
+	Password             *string
+	Network              *string
+	Datastore            *string
+	Datacenter           *string
+	Pool                 *string
+	HostIP               *string
+	NFSShare             *bool
+	NFSSharePath         *string
+	Template             *string
+	ContentLibrary       *string
+	ContentLibraryItem   *string
+	Boot2DockerURLSHA256 *string
 }
 
 func init() {
@@ -87,6 +97,12 @@ func RegisterCreateFlags(cmd *flag.FlagSet) interface{} {
 	createFlags.Datacenter = cmd.String([]string{"-vsphere-datacenter"}, "", "vSphere datacenter for docker VM")
 	createFlags.Pool = cmd.String([]string{"-vsphere-pool"}, "", "vSphere resource pool for docker VM")
 	createFlags.HostIP = cmd.String([]string{"-vsphere-compute-ip"}, "", "vSphere compute host IP where the docker VM will be instantiated")
+	createFlags.NFSShare = cmd.Bool([]string{"-vsphere-nfs-share"}, false, "Export and mount an NFS share from the workstation into the docker VM")
+	createFlags.NFSSharePath = cmd.String([]string{"-vsphere-nfs-share-path"}, "", "Host directory to export over NFS (required when --vsphere-nfs-share is set)")
+	createFlags.Template = cmd.String([]string{"-vsphere-template"}, "", "Name of an existing vSphere VM template to clone instead of the boot2docker ISO (mutually exclusive with --vsphere-boot2docker-url)")
+	createFlags.ContentLibrary = cmd.String([]string{"-vsphere-content-library"}, "", "Content Library containing the OVF template to deploy")
+	createFlags.ContentLibraryItem = cmd.String([]string{"-vsphere-content-library-item"}, "", "Content Library item (OVF template) to deploy instead of the boot2docker ISO")
+	createFlags.Boot2DockerURLSHA256 = cmd.String([]string{"-vsphere-boot2docker-url-sha256"}, "", "Expected SHA256 checksum of the boot2docker image; defaults to fetching <url>.sha256")
 	return createFlags
 }
 
@@ -114,6 +130,26 @@ func (d *Driver) SetConfigFromFlags(flagsInterface interface{}) error {
 	d.Datacenter = *flags.Datacenter
 	d.Pool = *flags.Pool
 	d.HostIP = *flags.HostIP
+	d.NFSShare = *flags.NFSShare
+	d.NFSSharePath = *flags.NFSSharePath
+	d.Template = *flags.Template
+	d.ContentLibrary = *flags.ContentLibrary
+	d.ContentLibraryItem = *flags.ContentLibraryItem
+	d.Boot2DockerURLSHA256 = *flags.Boot2DockerURLSHA256
+
+	if d.NFSShare && d.NFSSharePath == "" {
+		return errors.NewIncompleteVsphereConfigError("vSphere NFS share path")
+	}
+
+	if d.Boot2DockerURL != "" && (d.Template != "" || d.ContentLibraryItem != "") {
+		return fmt.Errorf("--vsphere-boot2docker-url cannot be used together with --vsphere-template or --vsphere-content-library-item")
+	}
+	if d.Template != "" && d.ContentLibraryItem != "" {
+		return fmt.Errorf("--vsphere-template and --vsphere-content-library-item are mutually exclusive")
+	}
+	if d.ContentLibraryItem != "" && d.ContentLibrary == "" {
+		return errors.NewIncompleteVsphereConfigError("vSphere content library")
+	}
 
 	d.ISO = path.Join(d.storePath, "boot2docker.iso")
 
@@ -133,35 +169,36 @@ func (d *Driver) GetIP() (string, error) {
 	if status != state.Running {
 		return "", errors.NewInvalidStateError(d.MachineName)
 	}
-	vcConn := NewVcConn(d)
-	rawIp, err := vcConn.VmFetchIp()
+	vc, err := NewVcClient(d)
 	if err != nil {
 		return "", err
 	}
-	ip := strings.Trim(strings.Split(rawIp, "\n")[0], " ")
-	return ip, nil
+	return vc.VmFetchIP()
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	vcConn := NewVcConn(d)
-	stdout, err := vcConn.VmInfo()
+	vc, err := NewVcClient(d)
+	if err != nil {
+		return state.None, err
+	}
+	powerState, err := vc.VmPowerState()
 	if err != nil {
 		return state.None, err
 	}
 
-	if strings.Contains(stdout, "poweredOn") {
+	switch powerState {
+	case types.VirtualMachinePowerStatePoweredOn:
 		return state.Running, nil
-	} else if strings.Contains(stdout, "poweredOff") {
+	case types.VirtualMachinePowerStatePoweredOff:
 		return state.Stopped, nil
 	}
 	return state.None, nil
 }
 
-// the current implementation does the following:
-// 1. check whether the docker directory contains the boot2docker ISO
-// 2. generate an SSH keypair
-// 3. create a virtual machine with the boot2docker ISO mounted;
-// 4. reconfigure the virtual machine network and disk size;
+// Create provisions the docker VM using one of three mutually exclusive
+// modes selected at SetConfigFromFlags time: booting the boot2docker ISO
+// (the default), cloning an existing VM template (--vsphere-template), or
+// deploying a Content Library OVF item (--vsphere-content-library-item).
 func (d *Driver) Create() error {
 	d.setMachineNameIfNotSet()
 
@@ -169,6 +206,46 @@ func (d *Driver) Create() error {
 		return err
 	}
 
+	log.Infof("Generating SSH Keypair...")
+	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
+		return err
+	}
+
+	vc, err := NewVcClient(d)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case d.ContentLibraryItem != "":
+		if err := d.createFromContentLibrary(vc); err != nil {
+			return err
+		}
+	case d.Template != "":
+		if err := d.createFromTemplate(vc); err != nil {
+			return err
+		}
+	default:
+		if err := d.createFromISO(vc); err != nil {
+			return err
+		}
+	}
+
+	if err := d.provisionCloudInit(vc); err != nil {
+		return err
+	}
+
+	if err := d.Start(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createFromISO is the original creation path: a blank VM with the
+// boot2docker ISO mounted, reconfigured with the requested disk size and
+// network.
+func (d *Driver) createFromISO(vc *VcClient) error {
 	var isoURL string
 	if d.Boot2DockerURL != "" {
 		isoURL = d.Boot2DockerURL
@@ -177,18 +254,12 @@ func (d *Driver) Create() error {
 		isoURL = "https://github.com/cloudnativeapps/boot2docker/releases/download/1.3.1_vmw-identity/boot2docker.iso"
 	}
 	log.Infof("Downloading boot2docker...")
-	if err := downloadISO(d.storePath, "boot2docker.iso", isoURL); err != nil {
+	if err := downloadISO(d.storePath, "boot2docker.iso", isoURL, d.Boot2DockerURLSHA256); err != nil {
 		return err
 	}
 
-	log.Infof("Generating SSH Keypair...")
-	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
-		return err
-	}
-
-	vcConn := NewVcConn(d)
 	log.Infof("Uploading Boot2docker ISO ...")
-	if err := vcConn.DatastoreMkdir(DATASTORE_DIR); err != nil {
+	if err := vc.DatastoreMkdir(DATASTORE_DIR); err != nil {
 		return err
 	}
 
@@ -197,29 +268,47 @@ func (d *Driver) Create() error {
 		return errors.NewIncompleteVsphereConfigError(d.ISO)
 	}
 
-	if err := vcConn.DatastoreUpload(d.ISO); err != nil {
+	if err := vc.DatastoreUpload(d.ISO); err != nil {
 		return err
 	}
 
 	isoPath := fmt.Sprintf("%s/%s", DATASTORE_DIR, B2D_ISO_NAME)
-	if err := vcConn.VmCreate(isoPath); err != nil {
+	if err := vc.VmCreate(isoPath); err != nil {
 		return err
 	}
 
 	log.Infof("Configuring the virtual machine %s... ", d.MachineName)
-	if err := vcConn.VmDiskCreate(); err != nil {
+	if err := vc.VmDiskCreate(); err != nil {
 		return err
 	}
 
-	if err := vcConn.VmAttachNetwork(); err != nil {
+	return vc.VmAttachNetwork()
+}
+
+// createFromTemplate clones an existing vSphere VM template instead of
+// booting the boot2docker ISO, then resizes it to the requested CPU/memory/
+// disk. Templates are expected to already carry VMware tools and, ideally,
+// a cloud-init datasource; Start falls back to SSH bootstrap otherwise.
+func (d *Driver) createFromTemplate(vc *VcClient) error {
+	log.Infof("Cloning template %s into %s...", d.Template, d.MachineName)
+	if err := vc.VmCloneFromTemplate(d.Template); err != nil {
 		return err
 	}
 
-	if err := d.Start(); err != nil {
+	log.Infof("Resizing virtual machine %s... ", d.MachineName)
+	return vc.VmResize(d.CPU, d.Memory, d.DiskSize)
+}
+
+// createFromContentLibrary deploys a Content Library OVF item as the docker
+// VM, then resizes it to the requested CPU/memory/disk.
+func (d *Driver) createFromContentLibrary(vc *VcClient) error {
+	log.Infof("Deploying Content Library item %s/%s into %s...", d.ContentLibrary, d.ContentLibraryItem, d.MachineName)
+	if err := vc.VmDeployFromContentLibrary(d.ContentLibrary, d.ContentLibraryItem); err != nil {
 		return err
 	}
 
-	return nil
+	log.Infof("Resizing virtual machine %s... ", d.MachineName)
+	return vc.VmResize(d.CPU, d.Memory, d.DiskSize)
 }
 
 func (d *Driver) Start() error {
@@ -234,43 +323,70 @@ func (d *Driver) Start() error {
 		return nil
 	case state.Stopped:
 		// TODO add transactional or error handling in the following steps
-		vcConn := NewVcConn(d)
-		err := vcConn.VmPowerOn()
+		vc, err := NewVcClient(d)
 		if err != nil {
 			return err
 		}
+		if err := vc.VmPowerOn(); err != nil {
+			return err
+		}
 		// this step waits for the vm to start and fetch its ip address;
 		// this guarantees that the opem-vmtools has started working...
-		_, err = vcConn.VmFetchIp()
+		guestIP, err := vc.VmFetchIP()
 		if err != nil {
 			return err
 		}
+		d.guestIP = guestIP
 
 		log.Infof("Configuring virtual machine %s... ", d.MachineName)
-		err = vcConn.GuestMkdir("docker", "tcuser", "/home/docker/.ssh")
-		if err != nil {
-			return err
-		}
-
-		// configure the ssh key pair and download the pem file
-		err = vcConn.GuestUpload("docker", "tcuser", d.publicSSHKeyPath(),
-			"/home/docker/.ssh/authorized_keys")
+		cloudInitSupported, err := d.cloudInitSupported(vc)
 		if err != nil {
 			return err
 		}
 
-		// Add identity authorization keys
-		if err := drivers.AddPublicKeyToAuthorizedHosts(d, "/root/.docker/authorized-keys.d"); err != nil {
-			return err
+		if cloudInitSupported {
+			log.Infof("Waiting for cloud-init to finish provisioning %s...", d.MachineName)
+			if err := d.waitForCloudInit(vc); err != nil {
+				return err
+			}
+		} else {
+			// The guest has no cloud-init datasource to have picked up the
+			// SSH key injected via provisionCloudInit. Falling back to
+			// guest-ops key configuration here only makes sense for the ISO
+			// boot path, where the boot2docker image's docker/tcuser account
+			// is known to exist; a cloned template or deployed Content
+			// Library item has arbitrary guest credentials and is expected
+			// to carry a cloud-init datasource instead.
+			isISOBoot := d.Template == "" && d.ContentLibraryItem == ""
+			if isISOBoot {
+				if err := vc.GuestMkdir("docker", "tcuser", "/home/docker/.ssh"); err != nil {
+					return err
+				}
+				if err := vc.GuestUpload("docker", "tcuser", d.publicSSHKeyPath(),
+					"/home/docker/.ssh/authorized_keys"); err != nil {
+					return err
+				}
+				if err := drivers.AddPublicKeyToAuthorizedHosts(d, "/root/.docker/authorized-keys.d"); err != nil {
+					return err
+				}
+			}
+
+			log.Infof("boot2docker image does not advertise cloud-init support, falling back to SSH bootstrap...")
+
+			// Restart Docker
+			cmd, err := d.GetSSHCommand("sudo /etc/init.d/docker restart")
+			if err != nil {
+				return err
+			}
+			if err := cmd.Run(); err != nil {
+				return err
+			}
 		}
 
-		// Restart Docker
-		cmd, err := d.GetSSHCommand("sudo /etc/init.d/docker restart")
-		if err != nil {
-			return err
-		}
-		if err := cmd.Run(); err != nil {
-			return err
+		if d.NFSShare {
+			if err := d.startNFSShare(); err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -279,12 +395,17 @@ func (d *Driver) Start() error {
 }
 
 func (d *Driver) Stop() error {
-	vcConn := NewVcConn(d)
-	err := vcConn.VmPowerOff()
+	if d.NFSShare {
+		if err := d.stopNFSShare(); err != nil {
+			return err
+		}
+	}
+
+	vc, err := NewVcClient(d)
 	if err != nil {
 		return err
 	}
-	return err
+	return vc.VmPowerOff()
 }
 
 func (d *Driver) Remove() error {
@@ -297,12 +418,11 @@ func (d *Driver) Remove() error {
 			return fmt.Errorf("can't stop VM: %s", err)
 		}
 	}
-	vcConn := NewVcConn(d)
-	err = vcConn.VmDestroy()
+	vc, err := NewVcClient(d)
 	if err != nil {
 		return err
 	}
-	return nil
+	return vc.VmDestroy()
 }
 
 func (d *Driver) Restart() error {
@@ -364,33 +484,6 @@ func (d *Driver) checkVsphereConfig() error {
 	return nil
 }
 
-// Download boot2docker ISO image for the given tag and save it at dest.
-func downloadISO(dir, file, url string) error {
-	rsp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer rsp.Body.Close()
-
-	// Download to a temp file first then rename it to avoid partial download.
-	f, err := ioutil.TempFile(dir, file+".tmp")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(f.Name())
-	if _, err := io.Copy(f, rsp.Body); err != nil {
-		// TODO: display download progress?
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	if err := os.Rename(f.Name(), path.Join(dir, file)); err != nil {
-		return err
-	}
-	return nil
-}
-
 func generateVMName() string {
 	randomID := utils.TruncateID(utils.GenerateRandomID())
 	return fmt.Sprintf("docker-host-%s", randomID)